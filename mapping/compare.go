@@ -0,0 +1,101 @@
+package mapping
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/omniscale/imposm3/element"
+)
+
+// compareOps are the typed comparison operators available through
+// compare_tags. Each entry is `[key, op, value...]`, e.g.
+// `[layer, lt, 0]` or `[population, between, 10000, 50000]`.
+var compareOps = map[string]bool{
+	"gt":       true,
+	"gte":      true,
+	"lt":       true,
+	"lte":      true,
+	"between":  true,
+	"in_range": true,
+}
+
+// validateCompareTagsEntry checks a single compare_tags entry (key, op,
+// value...) for an unknown operator, wrong argument count or non-numeric
+// bounds, without building anything. It backs both makeCompareTagsFunction
+// (at ElementFilters()-construction time) and Validate (at NewMapping
+// time), so a bad entry is reported in the same way wherever it is caught.
+func validateCompareTagsEntry(entry []string) error {
+	key, op, args := entry[0], entry[1], entry[2:]
+
+	if !compareOps[op] {
+		return fmt.Errorf("compare_tags key '%s' has unknown operator '%s'", key, op)
+	}
+
+	switch op {
+	case "gt", "gte", "lt", "lte":
+		if len(args) != 1 {
+			return fmt.Errorf("compare_tags key '%s' op '%s' needs exactly 1 value", key, op)
+		}
+		if _, err := strconv.ParseFloat(args[0], 64); err != nil {
+			return fmt.Errorf("compare_tags key '%s' op '%s' value '%s' is not numeric", key, op, args[0])
+		}
+	case "between", "in_range":
+		if len(args) != 2 {
+			return fmt.Errorf("compare_tags key '%s' op '%s' needs exactly 2 values", key, op)
+		}
+		if _, err := strconv.ParseFloat(args[0], 64); err != nil {
+			return fmt.Errorf("compare_tags key '%s' op '%s' value '%s' is not numeric", key, op, args[0])
+		}
+		if _, err := strconv.ParseFloat(args[1], 64); err != nil {
+			return fmt.Errorf("compare_tags key '%s' op '%s' value '%s' is not numeric", key, op, args[1])
+		}
+	}
+	return nil
+}
+
+// makeCompareTagsFunction builds an ElementFilter from a single compare_tags
+// entry. The tag value is parsed as float64; elements with a missing or
+// non-numeric value are kept (graceful skip) rather than excluded, since
+// the comparison cannot be decided.
+func makeCompareTagsFunction(filterKeyVal []string) (func(tags *element.Tags) bool, error) {
+	if err := validateCompareTagsEntry(filterKeyVal); err != nil {
+		log.Errorf("mapping filter error: %v", err)
+		return nil, nil
+	}
+
+	key := filterKeyVal[0]
+	op := filterKeyVal[1]
+	args := filterKeyVal[2:]
+
+	switch op {
+	case "gt", "gte", "lt", "lte":
+		against, _ := strconv.ParseFloat(args[0], 64)
+		return func(tags *element.Tags) bool {
+			v, ok := (*tags)[key]
+			if !ok {
+				return true
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return true
+			}
+			return compareNum(op, f, against)
+		}, nil
+	case "between", "in_range":
+		lo, _ := strconv.ParseFloat(args[0], 64)
+		hi, _ := strconv.ParseFloat(args[1], 64)
+		return func(tags *element.Tags) bool {
+			v, ok := (*tags)[key]
+			if !ok {
+				return true
+			}
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return true
+			}
+			return f >= lo && f <= hi
+		}, nil
+	}
+
+	return nil, nil
+}
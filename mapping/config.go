@@ -18,6 +18,12 @@ type Field struct {
 	Type       string                 `yaml:"type"`
 	Args       map[string]interface{} `yaml:"args"`
 	FromMember bool                   `yaml:"from_member"`
+	// Transform is an ordered pipeline of value transforms (lower, upper,
+	// replace, template, ...), parsed when the mapping is loaded and applied
+	// by Field.TransformedValue. The column value generators do not call
+	// TransformedValue, so the pipeline does not change the values written
+	// to the DB. See field_transform.go.
+	Transform []fieldTransformStep `yaml:"transform"`
 }
 
 type Table struct {
@@ -29,6 +35,7 @@ type Table struct {
 	Fields       []*Field              `yaml:"columns"` // TODO rename Fields internaly to Columns
 	OldFields    []*Field              `yaml:"fields"`
 	Filters      *Filters              `yaml:"filters"`
+	Filter       *filterExprHolder     `yaml:"filter"`
 }
 
 type GeneralizedTable struct {
@@ -43,6 +50,9 @@ type Filters struct {
 	ExcludeNegatedTags       *[][]string `yaml:"exclude_negated_tags"`
 	ExcludeRegexpTags        *[][]string `yaml:"exclude_regexp_tags"`
 	ExcludeNegatedRegexpTags *[][]string `yaml:"exclude_negated_regexp_tags"`
+	// CompareTags holds typed numeric comparisons, e.g. [layer, lt, 0] or
+	// [population, between, 10000, 50000]. See compare.go.
+	CompareTags *[][]string `yaml:"compare_tags"`
 }
 
 type Tables map[string]*Table
@@ -173,6 +183,15 @@ func NewMapping(filename string) (*Mapping, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	if errs := mapping.Validate(f); len(errs) > 0 {
+		if fatal := errs.Fatal(); len(fatal) > 0 {
+			return nil, fatal
+		}
+		for _, e := range errs {
+			log.Warnf("mapping warning: %s", e.Error())
+		}
+	}
 	return &mapping, nil
 }
 
@@ -356,6 +375,13 @@ func makeElementRegexpFiltersFunction(virtualTrue bool, virtualFalse bool, filte
 func (m *Mapping) ElementFilters() map[string][]ElementFilter {
 	result := make(map[string][]ElementFilter)
 	for name, t := range m.Tables {
+		if t.Filter != nil && t.Filter.expr != nil {
+			expr := t.Filter.expr
+			result[name] = append(result[name], func(tags *element.Tags) bool {
+				return expr.Eval(tags)
+			})
+		}
+
 		if t.Filters == nil {
 			continue
 		}
@@ -408,6 +434,21 @@ func (m *Mapping) ElementFilters() map[string][]ElementFilter {
 			}
 		}
 
+		// compare_tags
+		if t.Filters.CompareTags != nil {
+			for _, filterKeyVal := range *t.Filters.CompareTags {
+				if len(filterKeyVal) < 3 {
+					log.Errorf("mapping filter parameter error: %s  key:%s  need a [key],[op],[value...] entry !", "compare_tags", filterKeyVal[0])
+					continue
+				}
+				fn, err := makeCompareTagsFunction(filterKeyVal)
+				if err != nil || fn == nil {
+					continue
+				}
+				result[name] = append(result[name], fn)
+			}
+		}
+
 	}
 	return result
 }
@@ -0,0 +1,661 @@
+package mapping
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/omniscale/imposm3/element"
+	"gopkg.in/yaml.v2"
+)
+
+func unmarshalTable(t *testing.T, data string) *Table {
+	var tbl Table
+	if err := yaml.Unmarshal([]byte(data), &tbl); err != nil {
+		t.Fatalf("unmarshal table: %v", err)
+	}
+	return &tbl
+}
+
+func TestFilterExprAllAnyNone(t *testing.T) {
+	tbl := unmarshalTable(t, `
+filter:
+  all:
+    - {key: highway, eq: primary}
+    - any:
+        - {key: bridge, eq: "yes"}
+        - {key: tunnel, eq: "yes"}
+    - none:
+        - {key: area, eq: "yes"}
+`)
+	if tbl.Filter == nil || tbl.Filter.expr == nil {
+		t.Fatal("expected a parsed filter expression")
+	}
+
+	cases := []struct {
+		tags  element.Tags
+		match bool
+	}{
+		{element.Tags{"highway": "primary", "bridge": "yes"}, true},
+		{element.Tags{"highway": "primary", "tunnel": "yes"}, true},
+		{element.Tags{"highway": "secondary", "bridge": "yes"}, false},
+		{element.Tags{"highway": "primary"}, false},
+		{element.Tags{"highway": "primary", "bridge": "yes", "area": "yes"}, false},
+	}
+	for _, c := range cases {
+		if got := tbl.Filter.expr.Eval(&c.tags); got != c.match {
+			t.Errorf("Eval(%v) = %v, want %v", c.tags, got, c.match)
+		}
+	}
+}
+
+func TestFilterExprMatchesAndExists(t *testing.T) {
+	tbl := unmarshalTable(t, `
+filter:
+  all:
+    - {key: name, matches: "^A.*"}
+    - {key: oneway, exists: true}
+`)
+	if tbl.Filter == nil || tbl.Filter.expr == nil {
+		t.Fatal("expected a parsed filter expression")
+	}
+
+	match := element.Tags{"name": "Avenue Road", "oneway": "yes"}
+	if !tbl.Filter.expr.Eval(&match) {
+		t.Error("expected match for name starting with A and oneway present")
+	}
+
+	noMatch := element.Tags{"name": "Avenue Road"}
+	if tbl.Filter.expr.Eval(&noMatch) {
+		t.Error("expected no match when oneway is missing")
+	}
+
+	wrongName := element.Tags{"name": "Baker Street", "oneway": "yes"}
+	if tbl.Filter.expr.Eval(&wrongName) {
+		t.Error("expected no match for name not starting with A")
+	}
+}
+
+func TestFilterExprInvalidPredicateIsRecordedNotFatal(t *testing.T) {
+	tbl := unmarshalTable(t, `
+filter:
+  all:
+    - {key: name, matches: "("}
+`)
+	if tbl.Filter == nil {
+		t.Fatal("expected a filter holder even for an invalid predicate")
+	}
+	if tbl.Filter.err == nil {
+		t.Fatal("expected the invalid regexp to be recorded as an error")
+	}
+	if tbl.Filter.expr != nil {
+		t.Error("expected no expr to be built for an invalid predicate")
+	}
+}
+
+func TestElementFiltersAppliesTableFilter(t *testing.T) {
+	m := &Mapping{Tables: Tables{
+		"roads": unmarshalTable(t, `
+filter:
+  all:
+    - {key: highway, eq: primary}
+`),
+	}}
+	m.Tables["roads"].Name = "roads"
+
+	filters := m.ElementFilters()["roads"]
+	if len(filters) != 1 {
+		t.Fatalf("expected 1 element filter, got %d", len(filters))
+	}
+
+	keep := element.Tags{"highway": "primary"}
+	if !filters[0](&keep) {
+		t.Error("expected keep=true for highway=primary")
+	}
+	drop := element.Tags{"highway": "secondary"}
+	if filters[0](&drop) {
+		t.Error("expected keep=false for highway=secondary")
+	}
+}
+
+func TestFilterExprNumericPredicates(t *testing.T) {
+	tbl := unmarshalTable(t, `
+filter:
+  all:
+    - {key: layer, gte: 1}
+    - {key: layer, lte: 5}
+    - {key: population, between: [10000, 50000]}
+`)
+	if tbl.Filter == nil || tbl.Filter.expr == nil {
+		t.Fatal("expected a parsed filter expression")
+	}
+
+	match := element.Tags{"layer": "3", "population": "20000"}
+	if !tbl.Filter.expr.Eval(&match) {
+		t.Error("expected match within all bounds")
+	}
+
+	tooHigh := element.Tags{"layer": "9", "population": "20000"}
+	if tbl.Filter.expr.Eval(&tooHigh) {
+		t.Error("expected no match when layer exceeds lte bound")
+	}
+
+	outsideRange := element.Tags{"layer": "3", "population": "500"}
+	if tbl.Filter.expr.Eval(&outsideRange) {
+		t.Error("expected no match when population is outside the between bounds")
+	}
+
+	nonNumeric := element.Tags{"layer": "not-a-number", "population": "20000"}
+	if tbl.Filter.expr.Eval(&nonNumeric) {
+		t.Error("expected no match when the tag value can't be parsed as a number")
+	}
+}
+
+func TestMakeCompareTagsFunction(t *testing.T) {
+	// makeCompareTagsFunction's ElementFilter returns the comparison result
+	// itself (true = keep), not an "exclude when true" style check.
+	cases := []struct {
+		entry []string
+		tags  element.Tags
+		keep  bool
+	}{
+		{[]string{"layer", "lt", "0"}, element.Tags{"layer": "-1"}, true},
+		{[]string{"layer", "lt", "0"}, element.Tags{"layer": "1"}, false},
+		{[]string{"population", "gte", "10000"}, element.Tags{"population": "10000"}, true},
+		{[]string{"population", "gte", "10000"}, element.Tags{"population": "999"}, false},
+		{[]string{"population", "in_range", "10000", "50000"}, element.Tags{"population": "30000"}, true},
+		{[]string{"population", "in_range", "10000", "50000"}, element.Tags{"population": "5"}, false},
+		// missing/non-numeric tag values are skipped (kept), not excluded
+		{[]string{"layer", "lt", "0"}, element.Tags{}, true},
+	}
+	for _, c := range cases {
+		fn, err := makeCompareTagsFunction(c.entry)
+		if err != nil {
+			t.Fatalf("makeCompareTagsFunction(%v): %v", c.entry, err)
+		}
+		if fn == nil {
+			t.Fatalf("makeCompareTagsFunction(%v): expected a filter func", c.entry)
+		}
+		if got := fn(&c.tags); got != c.keep {
+			t.Errorf("makeCompareTagsFunction(%v)(%v) = %v, want %v", c.entry, c.tags, got, c.keep)
+		}
+	}
+}
+
+func TestValidateCompareTagsEntry(t *testing.T) {
+	if err := validateCompareTagsEntry([]string{"layer", "lt", "0"}); err != nil {
+		t.Errorf("expected valid entry, got %v", err)
+	}
+	if err := validateCompareTagsEntry([]string{"layer", "between", "0", "not-a-number"}); err == nil {
+		t.Error("expected an error for a non-numeric between bound")
+	}
+	if err := validateCompareTagsEntry([]string{"layer", "frobnicate", "0"}); err == nil {
+		t.Error("expected an error for an unknown operator")
+	}
+}
+
+func unmarshalField(t *testing.T, data string) *Field {
+	var f Field
+	if err := yaml.Unmarshal([]byte(data), &f); err != nil {
+		t.Fatalf("unmarshal field: %v", err)
+	}
+	return &f
+}
+
+func TestFieldTransformedValueSimpleOps(t *testing.T) {
+	f := unmarshalField(t, `
+name: name
+key: name
+transform:
+  - trim
+  - lower
+`)
+	tags := element.Tags{"name": "  MAIN Street  "}
+	got, err := f.TransformedValue(&tags)
+	if err != nil {
+		t.Fatalf("TransformedValue: %v", err)
+	}
+	if want := "main street"; got != want {
+		t.Errorf("TransformedValue() = %q, want %q", got, want)
+	}
+}
+
+func TestFieldTransformReplaceAndRegexpReplace(t *testing.T) {
+	f := unmarshalField(t, `
+name: ref
+key: ref
+transform:
+  - replace: {from: "St.", to: "Street"}
+  - regexp_replace: {pattern: "\\s+", repl: " "}
+`)
+	tags := element.Tags{"ref": "Main   St."}
+	got, err := f.TransformedValue(&tags)
+	if err != nil {
+		t.Fatalf("TransformedValue: %v", err)
+	}
+	if want := "Main Street"; got != want {
+		t.Errorf("TransformedValue() = %q, want %q", got, want)
+	}
+}
+
+func TestFieldTransformSplit(t *testing.T) {
+	f := unmarshalField(t, `
+name: ref
+key: ref
+transform:
+  - split: {sep: ";", index: 1}
+`)
+	tags := element.Tags{"ref": "A1;A2;A3"}
+	got, err := f.TransformedValue(&tags)
+	if err != nil {
+		t.Fatalf("TransformedValue: %v", err)
+	}
+	if want := "A2"; got != want {
+		t.Errorf("TransformedValue() = %q, want %q", got, want)
+	}
+}
+
+func TestFieldTransformCoalesceAndDefault(t *testing.T) {
+	f := unmarshalField(t, `
+name: name
+key: name
+transform:
+  - coalesce: {keys: [name, ref]}
+  - default: {value: unnamed}
+`)
+
+	withName := element.Tags{"name": "Main Street", "ref": "A1"}
+	got, err := f.TransformedValue(&withName)
+	if err != nil {
+		t.Fatalf("TransformedValue: %v", err)
+	}
+	if want := "Main Street"; got != want {
+		t.Errorf("TransformedValue() = %q, want %q", got, want)
+	}
+
+	onlyRef := element.Tags{"ref": "A1"}
+	got, err = f.TransformedValue(&onlyRef)
+	if err != nil {
+		t.Fatalf("TransformedValue: %v", err)
+	}
+	if want := "A1"; got != want {
+		t.Errorf("TransformedValue() = %q, want %q (coalesce fallback)", got, want)
+	}
+
+	neither := element.Tags{}
+	got, err = f.TransformedValue(&neither)
+	if err != nil {
+		t.Fatalf("TransformedValue: %v", err)
+	}
+	if want := "unnamed"; got != want {
+		t.Errorf("TransformedValue() = %q, want %q (default fallback)", got, want)
+	}
+}
+
+func TestFieldTransformMap(t *testing.T) {
+	f := unmarshalField(t, `
+name: surface
+key: surface
+transform:
+  - map:
+      values: {paved: "1", unpaved: "0"}
+`)
+	paved := element.Tags{"surface": "paved"}
+	got, err := f.TransformedValue(&paved)
+	if err != nil {
+		t.Fatalf("TransformedValue: %v", err)
+	}
+	if want := "1"; got != want {
+		t.Errorf("TransformedValue() = %q, want %q", got, want)
+	}
+
+	unknown := element.Tags{"surface": "gravel"}
+	got, err = f.TransformedValue(&unknown)
+	if err != nil {
+		t.Fatalf("TransformedValue: %v", err)
+	}
+	if want := "gravel"; got != want {
+		t.Errorf("TransformedValue() = %q, want %q (unmapped value passes through)", got, want)
+	}
+}
+
+func TestFieldTransformTemplate(t *testing.T) {
+	f := unmarshalField(t, `
+name: label
+transform:
+  - template: {expr: "{name} ({ref})"}
+`)
+	tags := element.Tags{"name": "Main Street", "ref": "A1"}
+	got, err := f.TransformedValue(&tags)
+	if err != nil {
+		t.Fatalf("TransformedValue: %v", err)
+	}
+	if want := "Main Street (A1)"; got != want {
+		t.Errorf("TransformedValue() = %q, want %q", got, want)
+	}
+}
+
+func TestFieldTransformInvalidStepIsRecordedNotFatal(t *testing.T) {
+	f := unmarshalField(t, `
+name: name
+key: name
+transform:
+  - lower
+  - not_a_real_transform
+`)
+	if len(f.Transform) != 2 {
+		t.Fatalf("expected 2 transform steps, got %d", len(f.Transform))
+	}
+	if f.Transform[0].err != nil {
+		t.Errorf("expected the valid 'lower' step to parse cleanly, got err: %v", f.Transform[0].err)
+	}
+	if f.Transform[1].err == nil {
+		t.Fatal("expected the unknown transform name to be recorded as an error")
+	}
+	if f.Transform[1].transform != nil {
+		t.Error("expected no transform to be built for an invalid step")
+	}
+
+	// ApplyTransform/TransformedValue must not panic on the unbuilt step.
+	tags := element.Tags{"name": "MAIN Street"}
+	got, err := f.TransformedValue(&tags)
+	if err != nil {
+		t.Fatalf("TransformedValue: %v", err)
+	}
+	if want := "main street"; got != want {
+		t.Errorf("TransformedValue() = %q, want %q", got, want)
+	}
+}
+
+const watchTestMappingV1 = `
+tables:
+  roads:
+    type: linestring
+    columns:
+      - name: id
+        type: id
+`
+
+const watchTestMappingV2 = `
+tables:
+  roads:
+    type: linestring
+    columns:
+      - name: id
+        type: id
+  buildings:
+    type: polygon
+    columns:
+      - name: id
+        type: id
+`
+
+func TestWatchMappingPicksUpValidReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imposm3-mapping-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "mapping.yml")
+	if err := ioutil.WriteFile(file, []byte(watchTestMappingV1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := WatchMapping(file)
+	if err != nil {
+		t.Fatalf("WatchMapping: %v", err)
+	}
+	defer handle.Close()
+
+	if _, ok := handle.Mapping().Tables["roads"]; !ok {
+		t.Fatal("expected initial mapping to have table 'roads'")
+	}
+
+	if err := ioutil.WriteFile(file, []byte(watchTestMappingV2), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := handle.Mapping().Tables["buildings"]; ok {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("mapping handle did not pick up the file change within the deadline")
+}
+
+func TestWatchMappingRejectsInvalidReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imposm3-mapping-watch-invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "mapping.yml")
+	if err := ioutil.WriteFile(file, []byte(watchTestMappingV1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := WatchMapping(file)
+	if err != nil {
+		t.Fatalf("WatchMapping: %v", err)
+	}
+	defer handle.Close()
+
+	invalid := `
+tables:
+  roads:
+    type: not_a_real_type
+    columns:
+      - name: id
+        type: id
+`
+	if err := ioutil.WriteFile(file, []byte(invalid), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for positive evidence the watcher actually processed the bad
+	// edit and rejected it, rather than a flat sleep: a flat sleep can't
+	// distinguish "rejection works" from "the watcher never got around to
+	// looking at the event yet", so it would pass even if reload-rejection
+	// were completely broken.
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if handle.ReloadAttempts() > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if handle.ReloadAttempts() == 0 {
+		t.Fatal("watcher did not attempt a reload within the deadline")
+	}
+	if handle.LastReloadError() == nil {
+		t.Fatal("expected the reload attempt to have failed with an error")
+	}
+	if _, ok := handle.Mapping().Tables["roads"]; !ok {
+		t.Fatal("expected the previous valid mapping to still be active after a rejected reload")
+	}
+}
+
+func containsCode(errs MappingErrors, code string) bool {
+	for _, e := range errs {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func findCode(errs MappingErrors, code string) *MappingError {
+	for i, e := range errs {
+		if e.Code == code {
+			return &errs[i]
+		}
+	}
+	return nil
+}
+
+func TestValidateUnknownTableType(t *testing.T) {
+	m := &Mapping{Tables: Tables{"roads": {Name: "roads", Type: "bogus"}}}
+	errs := m.Validate(nil)
+	if !containsCode(errs, "unknown_table_type") {
+		t.Fatalf("expected unknown_table_type error, got %v", errs)
+	}
+	if len(errs.Fatal()) == 0 {
+		t.Error("expected unknown_table_type to be fatal")
+	}
+}
+
+func TestValidateUnknownFieldTypeIsWarningNotFatal(t *testing.T) {
+	m := &Mapping{Tables: Tables{"roads": {
+		Name: "roads", Type: PointTable,
+		Fields: []*Field{{Name: "foo", Type: "custom_registered_type"}},
+	}}}
+	errs := m.Validate(nil)
+	if !containsCode(errs, "unknown_field_type") {
+		t.Fatalf("expected unknown_field_type error, got %v", errs)
+	}
+	if len(errs.Fatal()) != 0 {
+		t.Errorf("expected unknown_field_type alone not to be fatal, got fatal errors: %v", errs.Fatal())
+	}
+}
+
+func TestValidateDuplicateTableNames(t *testing.T) {
+	source := []byte(`
+tables:
+  roads:
+    type: linestring
+    columns:
+      - name: id
+        type: id
+  roads:
+    type: polygon
+    columns:
+      - name: id
+        type: id
+`)
+	var m Mapping
+	if err := yaml.Unmarshal(source, &m); err != nil {
+		t.Fatal(err)
+	}
+	errs := m.Validate(source)
+	if !containsCode(errs, "duplicate_table_name") {
+		t.Fatalf("expected duplicate_table_name error, got %v", errs)
+	}
+}
+
+func TestValidateGeneralizedTableSource(t *testing.T) {
+	m := &Mapping{
+		Tables: Tables{"roads": {Name: "roads", Type: LineStringTable}},
+		GeneralizedTables: GeneralizedTables{
+			"roads_gen": {Name: "roads_gen", SourceTableName: "missing"},
+		},
+	}
+	errs := m.Validate(nil)
+	if !containsCode(errs, "unknown_generalized_source") {
+		t.Fatalf("expected unknown_generalized_source error, got %v", errs)
+	}
+}
+
+func TestValidateCyclicGeneralization(t *testing.T) {
+	m := &Mapping{
+		GeneralizedTables: GeneralizedTables{
+			"a": {Name: "a", SourceTableName: "b"},
+			"b": {Name: "b", SourceTableName: "a"},
+		},
+	}
+	errs := m.Validate(nil)
+	if !containsCode(errs, "cyclic_generalization") {
+		t.Fatalf("expected cyclic_generalization error, got %v", errs)
+	}
+}
+
+func TestValidateFilterArityAndRegexp(t *testing.T) {
+	badLen := [][]string{{"highway"}}
+	badRegexp := [][]string{{"name", "("}}
+	m := &Mapping{Tables: Tables{"roads": {
+		Name: "roads", Type: LineStringTable,
+		Filters: &Filters{ExcludeTags: &badLen, ExcludeRegexpTags: &badRegexp},
+	}}}
+	errs := m.Validate(nil)
+	arity := findCode(errs, "filter_arity")
+	if arity == nil {
+		t.Fatalf("expected filter_arity error, got %v", errs)
+	}
+	if arity.IsFatal() {
+		t.Error("expected filter_arity to be a non-fatal warning, matching ElementFilters()'s existing log-and-skip behavior for a short entry")
+	}
+	invalidRegexp := findCode(errs, "invalid_regexp")
+	if invalidRegexp == nil {
+		t.Fatalf("expected invalid_regexp error, got %v", errs)
+	}
+	if !invalidRegexp.IsFatal() {
+		t.Error("expected invalid_regexp to stay fatal: the pre-existing runtime path panics on a bad pattern instead of skipping it")
+	}
+}
+
+func TestValidateInvalidFilterExprIsAggregatedNotFatalAtParseTime(t *testing.T) {
+	tbl := unmarshalTable(t, `
+filter:
+  all:
+    - {key: name, matches: "("}
+`)
+	tbl.Name = "roads"
+	tbl.Type = LineStringTable
+	m := &Mapping{Tables: Tables{"roads": tbl}}
+	errs := m.Validate(nil)
+	if !containsCode(errs, "invalid_filter_expr") {
+		t.Fatalf("expected invalid_filter_expr error, got %v", errs)
+	}
+}
+
+func TestValidateInvalidCompareTags(t *testing.T) {
+	compareTags := [][]string{{"layer", "between", "0", "not-a-number"}}
+	m := &Mapping{Tables: Tables{"roads": {
+		Name: "roads", Type: LineStringTable,
+		Filters: &Filters{CompareTags: &compareTags},
+	}}}
+	errs := m.Validate(nil)
+	invalid := findCode(errs, "invalid_compare_tags")
+	if invalid == nil {
+		t.Fatalf("expected invalid_compare_tags error, got %v", errs)
+	}
+	if invalid.IsFatal() {
+		t.Error("expected invalid_compare_tags to be a non-fatal warning, matching makeCompareTagsFunction's existing log-and-skip behavior")
+	}
+}
+
+func TestValidateInvalidFieldTransform(t *testing.T) {
+	m := &Mapping{Tables: Tables{"roads": {
+		Name: "roads", Type: LineStringTable,
+		Fields: []*Field{unmarshalField(t, `
+name: name
+key: name
+transform:
+  - not_a_real_transform
+`)},
+	}}}
+	errs := m.Validate(nil)
+	invalid := findCode(errs, "invalid_field_transform")
+	if invalid == nil {
+		t.Fatalf("expected invalid_field_transform error, got %v", errs)
+	}
+	if !invalid.IsFatal() {
+		t.Error("expected invalid_field_transform to be fatal: transform has no prior graceful-skip runtime path to preserve")
+	}
+}
+
+func TestValidateEmptySubMapping(t *testing.T) {
+	m := &Mapping{Tables: Tables{"roads": {
+		Name: "roads", Type: LineStringTable,
+		Mappings: map[string]SubMapping{"foo": {}},
+	}}}
+	errs := m.Validate(nil)
+	if !containsCode(errs, "empty_submapping") {
+		t.Fatalf("expected empty_submapping error, got %v", errs)
+	}
+}
@@ -0,0 +1,271 @@
+package mapping
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/imposm3/element"
+)
+
+// FieldTransform is a single step in a Field's value transform pipeline.
+// Transforms run in order, each receiving the value produced by the
+// previous step (or the raw extracted value for the first step) plus the
+// element's tags, so steps like `coalesce` or `template` can pull in other
+// tags instead of just rewriting the piped-in value.
+type FieldTransform interface {
+	Transform(value string, tags *element.Tags) (string, error)
+}
+
+type lowerTransform struct{}
+
+func (lowerTransform) Transform(value string, tags *element.Tags) (string, error) {
+	return strings.ToLower(value), nil
+}
+
+type upperTransform struct{}
+
+func (upperTransform) Transform(value string, tags *element.Tags) (string, error) {
+	return strings.ToUpper(value), nil
+}
+
+type trimTransform struct{}
+
+func (trimTransform) Transform(value string, tags *element.Tags) (string, error) {
+	return strings.TrimSpace(value), nil
+}
+
+type replaceTransform struct {
+	from string
+	to   string
+}
+
+func (t replaceTransform) Transform(value string, tags *element.Tags) (string, error) {
+	return strings.Replace(value, t.from, t.to, -1), nil
+}
+
+type regexpReplaceTransform struct {
+	pattern *regexp.Regexp
+	repl    string
+}
+
+func (t regexpReplaceTransform) Transform(value string, tags *element.Tags) (string, error) {
+	return t.pattern.ReplaceAllString(value, t.repl), nil
+}
+
+type splitTransform struct {
+	sep   string
+	index int
+}
+
+func (t splitTransform) Transform(value string, tags *element.Tags) (string, error) {
+	parts := strings.Split(value, t.sep)
+	if t.index < 0 || t.index >= len(parts) {
+		return "", nil
+	}
+	return parts[t.index], nil
+}
+
+type coalesceTransform struct {
+	keys []Key
+}
+
+func (t coalesceTransform) Transform(value string, tags *element.Tags) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	for _, k := range t.keys {
+		if v, ok := (*tags)[string(k)]; ok && v != "" {
+			return v, nil
+		}
+	}
+	return "", nil
+}
+
+type defaultTransform struct {
+	value string
+}
+
+func (t defaultTransform) Transform(value string, tags *element.Tags) (string, error) {
+	if value == "" {
+		return t.value, nil
+	}
+	return value, nil
+}
+
+type mapTransform struct {
+	values map[string]string
+}
+
+func (t mapTransform) Transform(value string, tags *element.Tags) (string, error) {
+	if mapped, ok := t.values[value]; ok {
+		return mapped, nil
+	}
+	return value, nil
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+type templateTransform struct {
+	expr string
+}
+
+func (t templateTransform) Transform(value string, tags *element.Tags) (string, error) {
+	return templatePlaceholder.ReplaceAllStringFunc(t.expr, func(match string) string {
+		key := match[1 : len(match)-1]
+		if v, ok := (*tags)[key]; ok {
+			return v
+		}
+		return ""
+	}), nil
+}
+
+// fieldTransformStep unmarshals a single `transform` pipeline entry, which
+// is either a bare operation name ("lower") or a single-key map carrying
+// the operation's arguments ("replace: {from: a, to: b}").
+//
+// A malformed step (unknown transform name, bad regexp_replace pattern,
+// non-integer split.index) is recorded on err instead of being returned
+// from UnmarshalYAML, for the same reason filterExprHolder does this for
+// `filter:` nodes (see filter_expr.go): raising it here would abort
+// yaml.Unmarshal with a single raw error before Validate ever runs,
+// masking every other mapping problem. Validate reports err as a
+// MappingError.
+type fieldTransformStep struct {
+	transform FieldTransform
+	err       error
+}
+
+func (s *fieldTransformStep) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		t, err := buildSimpleTransform(name)
+		if err != nil {
+			s.err = err
+			return nil
+		}
+		s.transform = t
+		return nil
+	}
+
+	var op map[string]map[string]interface{}
+	if err := unmarshal(&op); err != nil {
+		return err
+	}
+	if len(op) != 1 {
+		s.err = fmt.Errorf("transform step must have exactly one operation, got %d", len(op))
+		return nil
+	}
+	for name, args := range op {
+		t, err := buildArgTransform(name, args)
+		if err != nil {
+			s.err = err
+			return nil
+		}
+		s.transform = t
+	}
+	return nil
+}
+
+func buildSimpleTransform(name string) (FieldTransform, error) {
+	switch name {
+	case "lower":
+		return lowerTransform{}, nil
+	case "upper":
+		return upperTransform{}, nil
+	case "trim":
+		return trimTransform{}, nil
+	}
+	return nil, fmt.Errorf("unknown transform '%s'", name)
+}
+
+func buildArgTransform(name string, args map[string]interface{}) (FieldTransform, error) {
+	switch name {
+	case "replace":
+		return replaceTransform{from: argString(args, "from"), to: argString(args, "to")}, nil
+	case "regexp_replace":
+		re, err := regexp.Compile(argString(args, "pattern"))
+		if err != nil {
+			return nil, fmt.Errorf("transform regexp_replace: %v", err)
+		}
+		return regexpReplaceTransform{pattern: re, repl: argString(args, "repl")}, nil
+	case "split":
+		index, err := strconv.Atoi(fmt.Sprint(args["index"]))
+		if err != nil {
+			return nil, fmt.Errorf("transform split: index must be an integer: %v", err)
+		}
+		return splitTransform{sep: argString(args, "sep"), index: index}, nil
+	case "coalesce":
+		rawKeys, _ := args["keys"].([]interface{})
+		keys := make([]Key, 0, len(rawKeys))
+		for _, k := range rawKeys {
+			keys = append(keys, Key(fmt.Sprint(k)))
+		}
+		return coalesceTransform{keys: keys}, nil
+	case "default":
+		return defaultTransform{value: argString(args, "value")}, nil
+	case "map":
+		rawValues, _ := args["values"].(map[interface{}]interface{})
+		values := make(map[string]string, len(rawValues))
+		for k, v := range rawValues {
+			values[fmt.Sprint(k)] = fmt.Sprint(v)
+		}
+		return mapTransform{values: values}, nil
+	case "template":
+		return templateTransform{expr: argString(args, "expr")}, nil
+	}
+	return nil, fmt.Errorf("unknown transform '%s'", name)
+}
+
+func argString(args map[string]interface{}, key string) string {
+	if v, ok := args[key]; ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// ApplyTransform runs the field's transform pipeline (if any) on value,
+// in order, returning the final result.
+func (f *Field) ApplyTransform(value string, tags *element.Tags) (string, error) {
+	for _, step := range f.Transform {
+		if step.transform == nil {
+			// Malformed step; Validate() reports this via step.err as a
+			// MappingError and NewMapping refuses to return such a mapping,
+			// so this is only reachable from code that builds a Field
+			// without validating it first. Leave the value untouched
+			// rather than panic on the nil transform.
+			continue
+		}
+		var err error
+		value, err = step.transform.Transform(value, tags)
+		if err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
+
+// rawValue looks up the field's tag value the same way ExtraTags reports
+// the keys it depends on: Key first, then the first present of Keys.
+func (f *Field) rawValue(tags *element.Tags) string {
+	if f.Key != "" {
+		if v, ok := (*tags)[string(f.Key)]; ok {
+			return v
+		}
+	}
+	for _, k := range f.Keys {
+		if v, ok := (*tags)[string(k)]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// TransformedValue extracts the field's raw tag value and then runs it
+// through the field's transform pipeline (if any), regardless of field
+// Type. The column value generators do not call it, so a field's
+// `transform` does not affect the value written to the DB.
+func (f *Field) TransformedValue(tags *element.Tags) (string, error) {
+	return f.ApplyTransform(f.rawValue(tags), tags)
+}
@@ -0,0 +1,244 @@
+package mapping
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/omniscale/imposm3/element"
+)
+
+// FilterExpr is a boolean expression tree evaluated against an element's
+// tags. It backs the `filter` field on Table, which allows arbitrary
+// AND/OR/NOT compositions of leaf predicates instead of the implicit
+// AND-only semantics of exclude_tags/exclude_negated_tags.
+type FilterExpr interface {
+	Eval(tags *element.Tags) bool
+}
+
+type allExpr struct {
+	children []FilterExpr
+}
+
+func (e *allExpr) Eval(tags *element.Tags) bool {
+	for _, c := range e.children {
+		if !c.Eval(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+type anyExpr struct {
+	children []FilterExpr
+}
+
+func (e *anyExpr) Eval(tags *element.Tags) bool {
+	for _, c := range e.children {
+		if c.Eval(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+type noneExpr struct {
+	children []FilterExpr
+}
+
+func (e *noneExpr) Eval(tags *element.Tags) bool {
+	for _, c := range e.children {
+		if c.Eval(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// predicateExpr is a single leaf condition, e.g. {key: highway, eq: primary}.
+type predicateExpr struct {
+	key     string
+	op      string
+	value   string
+	num     float64
+	rangeLo float64
+	rangeHi float64
+	re      *regexp.Regexp
+	exists  bool
+}
+
+func (e *predicateExpr) Eval(tags *element.Tags) bool {
+	v, ok := (*tags)[e.key]
+	switch e.op {
+	case "exists":
+		if e.exists {
+			return ok
+		}
+		return !ok
+	case "eq":
+		return ok && v == e.value
+	case "matches":
+		return ok && e.re.MatchString(v)
+	case "gt", "gte", "lt", "lte":
+		if !ok {
+			return false
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+		return compareNum(e.op, f, e.num)
+	case "between", "in_range":
+		if !ok {
+			return false
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return false
+		}
+		return f >= e.rangeLo && f <= e.rangeHi
+	}
+	return false
+}
+
+func compareNum(op string, v, against float64) bool {
+	switch op {
+	case "gt":
+		return v > against
+	case "gte":
+		return v >= against
+	case "lt":
+		return v < against
+	case "lte":
+		return v <= against
+	}
+	return false
+}
+
+// filterExprYAML mirrors the YAML shape of a filter expression node so it
+// can be unmarshalled into the FilterExpr tree below.
+type filterExprYAML struct {
+	All  []filterExprYAML `yaml:"all"`
+	Any  []filterExprYAML `yaml:"any"`
+	None []filterExprYAML `yaml:"none"`
+
+	Key     string     `yaml:"key"`
+	Eq      *string    `yaml:"eq"`
+	Gt      *float64   `yaml:"gt"`
+	Gte     *float64   `yaml:"gte"`
+	Lt      *float64   `yaml:"lt"`
+	Lte     *float64   `yaml:"lte"`
+	Between *[]float64 `yaml:"between"`
+	InRange *[]float64 `yaml:"in_range"`
+	Matches *string    `yaml:"matches"`
+	Exists  *bool      `yaml:"exists"`
+}
+
+func (n *filterExprYAML) toExpr() (FilterExpr, error) {
+	switch {
+	case n.All != nil:
+		children, err := toExprs(n.All)
+		if err != nil {
+			return nil, err
+		}
+		return &allExpr{children: children}, nil
+	case n.Any != nil:
+		children, err := toExprs(n.Any)
+		if err != nil {
+			return nil, err
+		}
+		return &anyExpr{children: children}, nil
+	case n.None != nil:
+		children, err := toExprs(n.None)
+		if err != nil {
+			return nil, err
+		}
+		return &noneExpr{children: children}, nil
+	}
+
+	if n.Key == "" {
+		return nil, fmt.Errorf("filter predicate missing 'key'")
+	}
+
+	switch {
+	case n.Eq != nil:
+		return &predicateExpr{key: n.Key, op: "eq", value: *n.Eq}, nil
+	case n.Gt != nil:
+		return &predicateExpr{key: n.Key, op: "gt", num: *n.Gt}, nil
+	case n.Gte != nil:
+		return &predicateExpr{key: n.Key, op: "gte", num: *n.Gte}, nil
+	case n.Lt != nil:
+		return &predicateExpr{key: n.Key, op: "lt", num: *n.Lt}, nil
+	case n.Lte != nil:
+		return &predicateExpr{key: n.Key, op: "lte", num: *n.Lte}, nil
+	case n.Between != nil:
+		lo, hi, err := rangeBounds(n.Key, "between", *n.Between)
+		if err != nil {
+			return nil, err
+		}
+		return &predicateExpr{key: n.Key, op: "between", rangeLo: lo, rangeHi: hi}, nil
+	case n.InRange != nil:
+		lo, hi, err := rangeBounds(n.Key, "in_range", *n.InRange)
+		if err != nil {
+			return nil, err
+		}
+		return &predicateExpr{key: n.Key, op: "in_range", rangeLo: lo, rangeHi: hi}, nil
+	case n.Matches != nil:
+		re, err := regexp.Compile(*n.Matches)
+		if err != nil {
+			return nil, fmt.Errorf("filter predicate key '%s' matches: %v", n.Key, err)
+		}
+		return &predicateExpr{key: n.Key, op: "matches", re: re}, nil
+	case n.Exists != nil:
+		return &predicateExpr{key: n.Key, op: "exists", exists: *n.Exists}, nil
+	}
+	return nil, fmt.Errorf("filter predicate key '%s' has no operator", n.Key)
+}
+
+func rangeBounds(key, op string, bounds []float64) (lo, hi float64, err error) {
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("filter predicate key '%s' %s needs exactly 2 values, got %d", key, op, len(bounds))
+	}
+	return bounds[0], bounds[1], nil
+}
+
+func toExprs(nodes []filterExprYAML) ([]FilterExpr, error) {
+	result := make([]FilterExpr, 0, len(nodes))
+	for i := range nodes {
+		expr, err := nodes[i].toExpr()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expr)
+	}
+	return result, nil
+}
+
+// filterExprHolder wraps FilterExpr so it can be unmarshalled directly as a
+// Table field while keeping FilterExpr an opaque interface everywhere else.
+//
+// A malformed expression (missing key, bad regexp, wrong `between` arity)
+// is recorded on err instead of being returned from UnmarshalYAML: raising
+// it here would abort yaml.Unmarshal with a single raw error before
+// Validate ever runs, defeating the point of aggregating every mapping
+// problem into one MappingErrors list. Validate reports err as a
+// MappingError; a genuinely malformed YAML node (wrong type for `all`,
+// etc.) still surfaces immediately since that comes from unmarshal itself.
+type filterExprHolder struct {
+	expr FilterExpr
+	err  error
+}
+
+func (h *filterExprHolder) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var node filterExprYAML
+	if err := unmarshal(&node); err != nil {
+		return err
+	}
+	expr, err := node.toExpr()
+	if err != nil {
+		h.err = err
+		return nil
+	}
+	h.expr = expr
+	return nil
+}
@@ -0,0 +1,385 @@
+package mapping
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SeverityError marks a MappingError that should keep NewMapping from
+// returning a usable mapping. SeverityWarning marks one that is worth
+// surfacing but describes a config pattern that still works at runtime
+// (e.g. a field type NewMapping doesn't recognize but that a deployment
+// registers itself) -- NewMapping logs these and still returns a mapping.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// MappingError is a single problem found while validating a mapping file.
+// Line is best-effort: it comes from a raw scan of the source YAML (see
+// lineIndex below), not a full YAML AST, so it may point at the start of
+// the enclosing block rather than the exact offending line.
+type MappingError struct {
+	Code     string
+	Path     string
+	Message  string
+	Line     int
+	Severity string // SeverityError (default) or SeverityWarning
+}
+
+func (e MappingError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: [%s] %s", e.Path, e.Line, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: [%s] %s", e.Path, e.Code, e.Message)
+}
+
+// IsFatal reports whether this error should keep NewMapping from returning
+// a mapping. Errors are fatal unless explicitly marked as warnings.
+func (e MappingError) IsFatal() bool {
+	return e.Severity != SeverityWarning
+}
+
+// MappingErrors aggregates every problem found by Validate so callers (and
+// NewMapping) can report them all at once instead of failing on the first.
+type MappingErrors []MappingError
+
+func (errs MappingErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = e.Error()
+	}
+	return fmt.Sprintf("%d mapping error(s):\n%s", len(errs), strings.Join(lines, "\n"))
+}
+
+// Fatal returns the subset of errs that are fatal (see MappingError.IsFatal).
+func (errs MappingErrors) Fatal() MappingErrors {
+	var fatal MappingErrors
+	for _, e := range errs {
+		if e.IsFatal() {
+			fatal = append(fatal, e)
+		}
+	}
+	return fatal
+}
+
+var knownTableTypes = map[TableType]bool{
+	PointTable:          true,
+	LineStringTable:     true,
+	PolygonTable:        true,
+	GeometryTable:       true,
+	RelationTable:       true,
+	RelationMemberTable: true,
+}
+
+// knownFieldTypes are the built-in column value generators. It is not
+// exhaustive of every custom type a deployment might register (custom
+// Go-side value generators are a supported, documented pattern), so an
+// unrecognized type is only ever reported as SeverityWarning -- it must
+// never block NewMapping on its own.
+var knownFieldTypes = map[string]bool{
+	"bool":               true,
+	"direction":          true,
+	"geometry":           true,
+	"validated_geometry": true,
+	"id":                 true,
+	"integer":            true,
+	"mapping_key":        true,
+	"mapping_value":      true,
+	"pg_hstore":          true,
+	"string":             true,
+	"wayzorder":          true,
+	"zorder":             true,
+}
+
+// Validate checks the mapping for problems that NewMapping's plain YAML
+// unmarshal cannot catch: unknown table/field types, duplicate table
+// names, dangling generalized_table sources, cyclic generalization
+// chains, broken filter regexps, malformed `filter` expression trees,
+// invalid compare_tags entries, malformed `transform` pipeline steps and
+// empty submappings. It returns every problem found rather than stopping
+// at the first one.
+func (m *Mapping) Validate(source []byte) MappingErrors {
+	var errs MappingErrors
+	lines := newLineIndex(source)
+
+	errs = append(errs, m.validateDuplicateTableNames(lines)...)
+
+	for name, t := range m.Tables {
+		path := fmt.Sprintf("tables.%s", name)
+		line := lines.forTable(name)
+
+		if !knownTableTypes[t.Type] {
+			errs = append(errs, MappingError{Code: "unknown_table_type", Path: path, Line: line,
+				Message: fmt.Sprintf("unknown table type '%s'", t.Type)})
+		}
+
+		for _, f := range t.Fields {
+			if f.Type != "" && !knownFieldTypes[f.Type] {
+				errs = append(errs, MappingError{Code: "unknown_field_type", Path: path + ".columns." + f.Name,
+					Line:     lines.forField(name, f.Name),
+					Message:  fmt.Sprintf("unknown field type '%s', assuming it is a custom registered type", f.Type),
+					Severity: SeverityWarning})
+			}
+			for i, step := range f.Transform {
+				if step.err != nil {
+					errs = append(errs, MappingError{Code: "invalid_field_transform",
+						Path:    fmt.Sprintf("%s.columns.%s.transform[%d]", path, f.Name, i),
+						Line:    lines.forField(name, f.Name),
+						Message: step.err.Error()})
+				}
+			}
+		}
+
+		if t.Filter != nil && t.Filter.err != nil {
+			errs = append(errs, MappingError{Code: "invalid_filter_expr", Path: path + ".filter", Line: line,
+				Message: t.Filter.err.Error()})
+		}
+
+		errs = append(errs, m.validateFilters(path, line, t.Filters)...)
+		errs = append(errs, m.validateSubMappings(path, line, t)...)
+	}
+
+	errs = append(errs, m.validateGeneralizedTables(lines)...)
+
+	return errs
+}
+
+func (m *Mapping) validateDuplicateTableNames(lines *lineIndex) MappingErrors {
+	var errs MappingErrors
+	seen := make(map[string]int)
+	for _, name := range lines.tableNamesInOrder {
+		seen[name]++
+		if seen[name] == 2 {
+			errs = append(errs, MappingError{Code: "duplicate_table_name", Path: "tables." + name,
+				Line: lines.forTable(name), Message: fmt.Sprintf("table name '%s' is defined more than once", name)})
+		}
+	}
+	return errs
+}
+
+func (m *Mapping) validateGeneralizedTables(lines *lineIndex) MappingErrors {
+	var errs MappingErrors
+
+	for name, gt := range m.GeneralizedTables {
+		path := "generalized_tables." + name
+		line := lines.forGeneralizedTable(name)
+
+		_, sourceIsTable := m.Tables[gt.SourceTableName]
+		_, sourceIsGeneralized := m.GeneralizedTables[gt.SourceTableName]
+		if !sourceIsTable && !sourceIsGeneralized {
+			errs = append(errs, MappingError{Code: "unknown_generalized_source", Path: path, Line: line,
+				Message: fmt.Sprintf("source '%s' is not a known table or generalized_table", gt.SourceTableName)})
+		}
+	}
+
+	for name := range m.GeneralizedTables {
+		if cycle := m.generalizationCycle(name); cycle != nil {
+			errs = append(errs, MappingError{Code: "cyclic_generalization", Path: "generalized_tables." + name,
+				Line:    lines.forGeneralizedTable(name),
+				Message: fmt.Sprintf("cyclic generalization chain: %s", strings.Join(cycle, " -> "))})
+		}
+	}
+
+	return errs
+}
+
+// generalizationCycle walks the source chain starting at name and returns
+// the chain (as table names) if it loops back on itself, or nil if it
+// terminates at a non-generalized table.
+func (m *Mapping) generalizationCycle(name string) []string {
+	visited := map[string]bool{name: true}
+	chain := []string{name}
+	current := name
+	for {
+		gt, ok := m.GeneralizedTables[current]
+		if !ok {
+			return nil
+		}
+		next := gt.SourceTableName
+		if visited[next] {
+			return append(chain, next)
+		}
+		if _, ok := m.GeneralizedTables[next]; !ok {
+			return nil
+		}
+		visited[next] = true
+		chain = append(chain, next)
+		current = next
+	}
+}
+
+// validateFilters checks the filters: block of a table.
+//
+// filter_arity and invalid_compare_tags are reported as SeverityWarning:
+// ElementFilters() has always handled a short exclude_tags/exclude_*_tags
+// entry or an invalid compare_tags op/bound by log.Errorf-ing and skipping
+// just that one entry (see ElementFilters and makeCompareTagsFunction), never by failing to build the mapping. Making
+// Validate fatal on them would be a behavior regression for an existing,
+// previously-working mapping with one bad filter entry, the same
+// backward-compatibility concern that keeps unknown_field_type a warning.
+//
+// invalid_regexp stays SeverityError: before this check existed, a bad
+// exclude_regexp_tags/exclude_negated_regexp_tags pattern reached
+// regexp.MustCompile in makeElementRegexpFiltersFunction and panicked the
+// first time ElementFilters() ran. Failing fast in NewMapping is strictly
+// better than that, not a regression, so there is no compatibility reason
+// to downgrade it.
+func (m *Mapping) validateFilters(path string, line int, f *Filters) MappingErrors {
+	if f == nil {
+		return nil
+	}
+	var errs MappingErrors
+
+	check := func(code string, entries *[][]string, minLen int) {
+		if entries == nil {
+			return
+		}
+		for _, entry := range *entries {
+			if len(entry) < minLen {
+				errs = append(errs, MappingError{Code: "filter_arity", Path: path + ".filters." + code, Line: line,
+					Message:  fmt.Sprintf("%s entry %v needs at least %d values", code, entry, minLen),
+					Severity: SeverityWarning})
+			}
+		}
+	}
+	check("exclude_tags", f.ExcludeTags, 2)
+	check("exclude_negated_tags", f.ExcludeNegatedTags, 2)
+	check("exclude_regexp_tags", f.ExcludeRegexpTags, 2)
+	check("exclude_negated_regexp_tags", f.ExcludeNegatedRegexpTags, 2)
+	check("compare_tags", f.CompareTags, 3)
+
+	if f.CompareTags != nil {
+		for _, entry := range *f.CompareTags {
+			if len(entry) < 3 {
+				continue // already reported by check() above
+			}
+			if err := validateCompareTagsEntry(entry); err != nil {
+				errs = append(errs, MappingError{Code: "invalid_compare_tags", Path: path + ".filters.compare_tags",
+					Line: line, Message: err.Error(), Severity: SeverityWarning})
+			}
+		}
+	}
+
+	checkRegexp := func(code string, entries *[][]string) {
+		if entries == nil {
+			return
+		}
+		for _, entry := range *entries {
+			if len(entry) != 2 {
+				if len(entry) > 2 {
+					errs = append(errs, MappingError{Code: "filter_arity", Path: path + ".filters." + code, Line: line,
+						Message:  fmt.Sprintf("%s entry %v needs exactly 2 values", code, entry),
+						Severity: SeverityWarning})
+				}
+				continue // shorter entries are already reported by check() above
+			}
+			if _, err := regexp.Compile(entry[1]); err != nil {
+				errs = append(errs, MappingError{Code: "invalid_regexp", Path: path + ".filters." + code, Line: line,
+					Message: fmt.Sprintf("%s key '%s': %v", code, entry[0], err)})
+			}
+		}
+	}
+	checkRegexp("exclude_regexp_tags", f.ExcludeRegexpTags)
+	checkRegexp("exclude_negated_regexp_tags", f.ExcludeNegatedRegexpTags)
+
+	return errs
+}
+
+// validateSubMappings flags submappings that structurally can never
+// match: one with no key/value entries produces no DestTable routing at
+// all (addFromMapping has nothing to add), regardless of what the rest of
+// the mapping does. This is deliberately named empty_submapping rather
+// than "unused": this package has no way to tell whether a non-empty
+// submapping's name is ever referenced by relation-member role matching
+// elsewhere, so it only reports the case it can prove statically rather
+// than claiming to detect every unused submapping.
+func (m *Mapping) validateSubMappings(path string, line int, t *Table) MappingErrors {
+	var errs MappingErrors
+	for subName, sub := range t.Mappings {
+		if len(sub.Mapping) == 0 {
+			errs = append(errs, MappingError{Code: "empty_submapping", Path: path + ".mappings." + subName, Line: line,
+				Message: fmt.Sprintf("submapping '%s' has no key/value entries, so it can never match", subName)})
+		}
+	}
+	return errs
+}
+
+// lineIndex is a best-effort line locator built by scanning the raw YAML
+// source for top-level table/field markers. It exists because the
+// production Mapping/Table/Field/KeyValues types are parsed with yaml.v2,
+// which collapses duplicate map keys and does not expose node positions,
+// so exact AST-based locations aren't available without a larger parser
+// migration.
+type lineIndex struct {
+	tableLine            map[string]int
+	tableNamesInOrder    []string
+	generalizedTableLine map[string]int
+	fieldLine            map[string]int // "table/field" -> line
+}
+
+var tableNameRe = regexp.MustCompile(`^  ([A-Za-z0-9_]+):\s*$`)
+var fieldNameRe = regexp.MustCompile(`^\s*-?\s*name:\s*([A-Za-z0-9_]+)\s*$`)
+var sectionRe = regexp.MustCompile(`^(\S.*):\s*$`)
+
+func newLineIndex(source []byte) *lineIndex {
+	idx := &lineIndex{
+		tableLine:            make(map[string]int),
+		generalizedTableLine: make(map[string]int),
+		fieldLine:            make(map[string]int),
+	}
+	if source == nil {
+		return idx
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(source))
+	section := ""
+	currentTable := ""
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		raw := scanner.Text()
+
+		if m := sectionRe.FindStringSubmatch(raw); m != nil {
+			section = m[1]
+			currentTable = ""
+			continue
+		}
+
+		if section == "tables" {
+			if m := tableNameRe.FindStringSubmatch(raw); m != nil {
+				currentTable = m[1]
+				idx.tableLine[currentTable] = lineNo
+				idx.tableNamesInOrder = append(idx.tableNamesInOrder, currentTable)
+				continue
+			}
+			if currentTable != "" {
+				if m := fieldNameRe.FindStringSubmatch(raw); m != nil {
+					idx.fieldLine[currentTable+"/"+m[1]] = lineNo
+				}
+			}
+		}
+
+		if section == "generalized_tables" {
+			if m := tableNameRe.FindStringSubmatch(raw); m != nil {
+				idx.generalizedTableLine[m[1]] = lineNo
+			}
+		}
+	}
+	return idx
+}
+
+func (idx *lineIndex) forTable(name string) int {
+	return idx.tableLine[name]
+}
+
+func (idx *lineIndex) forGeneralizedTable(name string) int {
+	return idx.generalizedTableLine[name]
+}
+
+func (idx *lineIndex) forField(table, field string) int {
+	return idx.fieldLine[table+"/"+field]
+}
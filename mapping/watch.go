@@ -0,0 +1,142 @@
+package mapping
+
+import (
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/fsnotify.v1"
+)
+
+// MappingHandle holds a live, atomically-swappable *Mapping that is kept in
+// sync with its backing YAML file. Use WatchMapping to create one for
+// long-running processes (imposm run / diff import) that should pick up
+// mapping edits without a restart.
+type MappingHandle struct {
+	mu             sync.RWMutex
+	mapping        *Mapping
+	filename       string
+	watcher        *fsnotify.Watcher
+	done           chan struct{}
+	reloadAttempts int
+	lastReloadErr  error
+}
+
+// WatchMapping loads filename like NewMapping and starts watching it for
+// changes. Later edits are parsed and validated before they are promoted;
+// an invalid edit is logged and ignored, leaving the previously loaded
+// mapping in place.
+func WatchMapping(filename string) (*MappingHandle, error) {
+	m, err := NewMapping(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// Watch the containing directory rather than the file itself so we
+	// still notice editors that replace the file (rename over write).
+	if err := watcher.Add(filepath.Dir(filename)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	h := &MappingHandle{
+		mapping:  m,
+		filename: filename,
+		watcher:  watcher,
+		done:     make(chan struct{}),
+	}
+	go h.run()
+	return h, nil
+}
+
+// Mapping returns the currently active mapping. Safe for concurrent use
+// with reloads triggered by file changes.
+func (h *MappingHandle) Mapping() *Mapping {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.mapping
+}
+
+// ElementFilters forwards to the currently active mapping's ElementFilters.
+func (h *MappingHandle) ElementFilters() map[string][]ElementFilter {
+	return h.Mapping().ElementFilters()
+}
+
+// tables forwards to the currently active mapping's tables, so callers
+// within the package that need per-geometry-type table info pick up
+// reloads the same way ElementFilters does.
+func (h *MappingHandle) tables(tableType TableType) map[string]*TableFields {
+	return h.Mapping().tables(tableType)
+}
+
+// mappings forwards to the currently active mapping's mappings.
+func (h *MappingHandle) mappings(tableType TableType, mappings TagTables) {
+	h.Mapping().mappings(tableType, mappings)
+}
+
+// ReloadAttempts returns how many times the watcher has tried to reload the
+// mapping file, successful or not. Mainly useful for tests that need to
+// observe a reload was actually processed rather than guessing at a sleep
+// duration.
+func (h *MappingHandle) ReloadAttempts() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.reloadAttempts
+}
+
+// LastReloadError returns the error from the most recent reload attempt, or
+// nil if the most recent attempt succeeded (or none has happened yet).
+func (h *MappingHandle) LastReloadError() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.lastReloadErr
+}
+
+// Close stops watching the mapping file.
+func (h *MappingHandle) Close() error {
+	close(h.done)
+	return h.watcher.Close()
+}
+
+func (h *MappingHandle) run() {
+	for {
+		select {
+		case ev, ok := <-h.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) != filepath.Clean(h.filename) {
+				continue
+			}
+			h.reload()
+		case err, ok := <-h.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("mapping watch error for %s: %v", h.filename, err)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *MappingHandle) reload() {
+	m, err := NewMapping(h.filename)
+	if err != nil {
+		log.Errorf("mapping reload of %s rejected, keeping previous mapping: %v", h.filename, err)
+		h.mu.Lock()
+		h.reloadAttempts++
+		h.lastReloadErr = err
+		h.mu.Unlock()
+		return
+	}
+	h.mu.Lock()
+	h.mapping = m
+	h.reloadAttempts++
+	h.lastReloadErr = nil
+	h.mu.Unlock()
+	log.Printf("mapping %s reloaded", h.filename)
+}